@@ -0,0 +1,97 @@
+// Package retry implements jittered exponential backoff for the transient
+// network and throttling failures the provider backends can return.
+package retry
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/zupzup/static-aws-deploy/provider"
+)
+
+// Config controls how a Do call paces its retries
+type Config struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultConfig is used wherever a zero-value Config is supplied
+var DefaultConfig = Config{
+	MaxAttempts:  5,
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+}
+
+// withDefaults fills in zero fields of config with DefaultConfig's values
+func withDefaults(config Config) Config {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultConfig.MaxAttempts
+	}
+	if config.InitialDelay <= 0 {
+		config.InitialDelay = DefaultConfig.InitialDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultConfig.MaxDelay
+	}
+	return config
+}
+
+// Do calls fn until it succeeds, fn's error isn't retryable, or config's
+// attempt budget is exhausted, sleeping a jittered exponential backoff
+// between attempts. The delay a StatusError's Retry-After header asks for
+// always takes precedence over the computed backoff.
+func Do(config Config, fn func() error) error {
+	config = withDefaults(config)
+	var err error
+	delay := config.InitialDelay
+	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		retryable, retryAfter := IsRetryable(err)
+		if !retryable || attempt == config.MaxAttempts {
+			return err
+		}
+		wait := jitter(delay)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		time.Sleep(wait)
+		delay *= 2
+		if delay > config.MaxDelay {
+			delay = config.MaxDelay
+		}
+	}
+	return err
+}
+
+// jitter returns a random duration in [d/2, d], so that retrying callers
+// don't all wake up and hammer the backend at the same instant
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half+1)))
+}
+
+// IsRetryable reports whether err is worth retrying, and the delay the
+// backend explicitly asked for via Retry-After, if any
+func IsRetryable(err error) (bool, time.Duration) {
+	var statusErr *provider.StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Status == 429 || statusErr.Status >= 500 || statusErr.Code == "SlowDown" || statusErr.Code == "RequestLimitExceeded" {
+			return true, statusErr.RetryAfter
+		}
+		return false, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0
+	}
+	return false, 0
+}
@@ -0,0 +1,358 @@
+// Package s3test runs an in-process HTTP server emulating the subset of the
+// S3 and CloudFront APIs static-aws-deploy talks to, so the upload and
+// invalidate packages can be exercised end-to-end without network access or
+// real credentials.
+package s3test
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// object is a single stored S3 object
+type object struct {
+	Body         []byte
+	ETag         string
+	LastModified time.Time
+}
+
+// multipartUpload tracks the parts uploaded for an in-progress multipart
+// upload, keyed by part number
+type multipartUpload struct {
+	Bucket string
+	Key    string
+	Parts  map[int][]byte
+}
+
+// Invalidation records a single CloudFront invalidation request received by
+// the server
+type Invalidation struct {
+	Distribution string
+	Paths        []string
+}
+
+// Server is an in-memory S3 + CloudFront stand-in for tests
+type Server struct {
+	mu       sync.Mutex
+	objects  map[string]map[string]*object
+	uploads  map[string]*multipartUpload
+	uploadID int
+
+	failRemaining int
+	failStatus    int
+	corruptETag   bool
+
+	Invalidations []Invalidation
+
+	srv *httptest.Server
+}
+
+// New starts a Server listening on a local port. Callers must Close it.
+func New() *Server {
+	s := &Server{
+		objects: make(map[string]map[string]*object),
+		uploads: make(map[string]*multipartUpload),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL is the base URL of the running server
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// FailNext makes the next n requests fail with the given HTTP status, to
+// exercise retry logic
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRemaining = n
+	s.failStatus = status
+}
+
+// CorruptNextETag makes the next successful Put return a deliberately wrong
+// ETag, to exercise delta-upload mismatch handling
+func (s *Server) CorruptNextETag() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corruptETag = true
+}
+
+// takeFailure reports whether the current request should be failed, and
+// consumes one unit of the remaining failure budget if so
+func (s *Server) takeFailure() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failRemaining <= 0 {
+		return 0, false
+	}
+	s.failRemaining--
+	return s.failStatus, true
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/2016-11-25/distribution/") {
+		s.handleInvalidation(w, r)
+		return
+	}
+	if status, fail := s.takeFailure(); fail {
+		w.WriteHeader(status)
+		return
+	}
+
+	bucket, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+	switch {
+	case r.Method == "GET" && query.Get("list-type") == "2":
+		s.handleList(w, bucket)
+	case r.Method == "POST" && hasQueryKey(query, "uploads"):
+		s.handleInitiateMultipart(w, bucket, key)
+	case r.Method == "PUT" && query.Get("partNumber") != "":
+		s.handleUploadPart(w, r, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		s.handleCompleteMultipart(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		s.handleAbortMultipart(w, bucket, key, query.Get("uploadId"))
+	case r.Method == "PUT":
+		s.handlePut(w, r, bucket, key)
+	case r.Method == "DELETE":
+		s.handleDelete(w, bucket, key)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// hasQueryKey reports whether key is present in query, regardless of value
+func hasQueryKey(query map[string][]string, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+// splitPath splits a path-style request path into bucket and key
+func splitPath(path string) (bucket, key string) {
+	trimmed := strings.TrimPrefix(path, "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	bucket = parts[0]
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	return bucket, key
+}
+
+func (s *Server) bucket(name string) map[string]*object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[name]
+	if !ok {
+		b = make(map[string]*object)
+		s.objects[name] = b
+	}
+	return b
+}
+
+func (s *Server) handleList(w http.ResponseWriter, bucket string) {
+	b := s.bucket(bucket)
+	s.mu.Lock()
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement("ListBucketResult")
+	for _, k := range keys {
+		obj := b[k]
+		contents := root.CreateElement("Contents")
+		contents.CreateElement("Key").SetText(k)
+		contents.CreateElement("ETag").SetText(fmt.Sprintf("%q", obj.ETag))
+		contents.CreateElement("LastModified").SetText(obj.LastModified.UTC().Format(time.RFC3339Nano))
+	}
+	s.mu.Unlock()
+
+	body, err := doc.WriteToBytes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	etag := s.store(bucket, key, body)
+	w.Header().Set("ETag", fmt.Sprintf("%q", etag))
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, bucket, key string) {
+	b := s.bucket(bucket)
+	s.mu.Lock()
+	delete(b, key)
+	s.mu.Unlock()
+}
+
+// store saves body under bucket/key and returns the ETag assigned to it,
+// honoring a pending CorruptNextETag request
+func (s *Server) store(bucket, key string, body []byte) string {
+	etag := fmt.Sprintf("%x", md5.Sum(body))
+
+	s.mu.Lock()
+	if s.corruptETag {
+		etag = etag[:len(etag)-1] + "0"
+		s.corruptETag = false
+	}
+	s.mu.Unlock()
+
+	b := s.bucket(bucket)
+	s.mu.Lock()
+	b[key] = &object{Body: body, ETag: etag, LastModified: time.Now()}
+	s.mu.Unlock()
+	return etag
+}
+
+func (s *Server) handleInitiateMultipart(w http.ResponseWriter, bucket, key string) {
+	s.mu.Lock()
+	s.uploadID++
+	id := strconv.Itoa(s.uploadID)
+	s.uploads[id] = &multipartUpload{Bucket: bucket, Key: key, Parts: make(map[int][]byte)}
+	s.mu.Unlock()
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement("InitiateMultipartUploadResult")
+	root.CreateElement("UploadId").SetText(id)
+	body, _ := doc.WriteToBytes()
+	w.Write(body)
+}
+
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID, partNumberStr string) {
+	partNumber, err := strconv.Atoi(partNumberStr)
+	if err != nil {
+		http.Error(w, "invalid partNumber", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	upload, ok := s.uploads[uploadID]
+	if ok {
+		upload.Parts[partNumber] = body
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown uploadId", http.StatusNotFound)
+		return
+	}
+
+	etag := fmt.Sprintf("%x", md5.Sum(body))
+	w.Header().Set("ETag", fmt.Sprintf("%q", etag))
+}
+
+func (s *Server) handleCompleteMultipart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) {
+	s.mu.Lock()
+	upload, ok := s.uploads[uploadID]
+	delete(s.uploads, uploadID)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown uploadId", http.StatusNotFound)
+		return
+	}
+
+	partNumbers := make([]int, 0, len(upload.Parts))
+	for n := range upload.Parts {
+		partNumbers = append(partNumbers, n)
+	}
+	sort.Ints(partNumbers)
+
+	var concatenated []byte
+	var body []byte
+	for _, n := range partNumbers {
+		part := upload.Parts[n]
+		sum := md5.Sum(part)
+		concatenated = append(concatenated, sum[:]...)
+		body = append(body, part...)
+	}
+	etag := fmt.Sprintf("%x-%d", md5.Sum(concatenated), len(partNumbers))
+
+	// stored directly rather than via store, so a pending CorruptNextETag
+	// is left for the next Put instead of being consumed and overwritten
+	b := s.bucket(bucket)
+	s.mu.Lock()
+	b[key] = &object{Body: body, ETag: etag, LastModified: time.Now()}
+	s.mu.Unlock()
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement("CompleteMultipartUploadResult")
+	root.CreateElement("ETag").SetText(fmt.Sprintf("%q", etag))
+	respBody, _ := doc.WriteToBytes()
+	w.Write(respBody)
+}
+
+func (s *Server) handleAbortMultipart(w http.ResponseWriter, bucket, key, uploadID string) {
+	s.mu.Lock()
+	delete(s.uploads, uploadID)
+	s.mu.Unlock()
+}
+
+func (s *Server) handleInvalidation(w http.ResponseWriter, r *http.Request) {
+	if status, fail := s.takeFailure(); fail {
+		w.WriteHeader(status)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// parts: ["2016-11-25", "distribution", "{id}", "invalidation"]
+	if len(parts) < 3 {
+		http.Error(w, "malformed invalidation path", http.StatusBadRequest)
+		return
+	}
+	distribution := parts[2]
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var paths []string
+	if batch := doc.SelectElement("InvalidationBatch"); batch != nil {
+		if pathsEl := batch.SelectElement("Paths"); pathsEl != nil {
+			if items := pathsEl.SelectElement("Items"); items != nil {
+				for _, item := range items.SelectElements("Path") {
+					paths = append(paths, item.Text())
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.Invalidations = append(s.Invalidations, Invalidation{Distribution: distribution, Paths: paths})
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+}
@@ -1,11 +1,11 @@
 package invalidate
 
 import (
+	stderrors "errors"
 	"fmt"
-	"github.com/beevik/etree"
-	awsauth "github.com/smartystreets/go-aws-auth"
-	"io"
-	"net/http"
+	"github.com/zupzup/static-aws-deploy/events"
+	"github.com/zupzup/static-aws-deploy/internal/retry"
+	"github.com/zupzup/static-aws-deploy/provider"
 	"time"
 )
 
@@ -17,77 +17,93 @@ type Config struct {
 		Key       string
 	}
 	Invalidation []string
+	// Backend selects and configures the storage provider whose CDN gets
+	// invalidated. Backend.Provider defaults to AWS CloudFront when empty.
+	Backend struct {
+		Provider        string
+		Endpoint        string
+		Region          string
+		PathStyle       bool   `yaml:"path_style"`
+		CDNEndpoint     string `yaml:"cdn_endpoint"`
+		CredentialsFile string `yaml:"credentials_file"`
+	}
+	// Retry configures the backoff used for transient invalidation failures,
+	// including CloudFront's invalidation rate throttling. Zero values fall
+	// back to retry.DefaultConfig.
+	Retry struct {
+		MaxAttempts  int           `yaml:"max_attempts"`
+		InitialDelay time.Duration `yaml:"initial_delay"`
+		MaxDelay     time.Duration `yaml:"max_delay"`
+	}
+}
+
+// retryConfig builds a retry.Config from config.Retry
+func retryConfig(config *Config) retry.Config {
+	return retry.Config{
+		MaxAttempts:  config.Retry.MaxAttempts,
+		InitialDelay: config.Retry.InitialDelay,
+		MaxDelay:     config.Retry.MaxDelay,
+	}
 }
 
-// Do sends the invalidation URLs to cloudfront
-func Do(config *Config, dryRun bool, logger io.Writer) error {
+// newProvider builds the Provider selected by config.Backend.Provider
+func newProvider(config *Config) (provider.Provider, error) {
+	return provider.New(provider.Config{
+		Name:            config.Backend.Provider,
+		Accesskey:       config.Distribution.Accesskey,
+		Key:             config.Distribution.Key,
+		Endpoint:        config.Backend.Endpoint,
+		Region:          config.Backend.Region,
+		PathStyle:       config.Backend.PathStyle,
+		CDNEndpoint:     config.Backend.CDNEndpoint,
+		CredentialsFile: config.Backend.CredentialsFile,
+	})
+}
+
+// Do sends the invalidation URLs to the configured backend's CDN, emitting
+// an events.Event recording the outcome
+func Do(config *Config, dryRun bool, logger *events.Logger) error {
 	if len(config.Invalidation) == 0 {
 		return fmt.Errorf("no invalidation paths specified")
 	}
 	if config.Distribution.Id == "" {
 		return fmt.Errorf("no distribution specified")
 	}
-	fmt.Fprintf(logger, "Invalidating %d Cloudfront URLs\n", len(config.Invalidation))
 	if dryRun {
 		for _, path := range config.Invalidation {
-			fmt.Fprintln(logger, path)
-		}
-	} else {
-		doc := createXML(config)
-		if err := invalidate(doc, config, logger); err != nil {
-			return err
+			logger.Emit(events.Event{Action: events.ActionDryRun, Key: path})
 		}
+		return nil
 	}
-	return nil
+	return invalidate(config, logger)
 }
 
-// createXML creates the request payload for the invalidation request
-func createXML(config *Config) *etree.Document {
-	doc := etree.NewDocument()
-	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
-	invalidationBatch := doc.CreateElement("InvalidationBatch")
-	callerReference := invalidationBatch.CreateElement("CallerReference")
-	callerReference.SetText(fmt.Sprintf("%s - %s", config.Distribution.Id, time.Now()))
-	paths := invalidationBatch.CreateElement("Paths")
-	items := paths.CreateElement("Items")
-	for _, path := range config.Invalidation {
-		item := items.CreateElement("Path")
-		item.SetText(path)
-	}
-	quantity := paths.CreateElement("Quantity")
-	quantity.SetText(fmt.Sprintf("%d", len(config.Invalidation)))
-	return doc
-}
-
-// invalidate executes the invalidation request
-func invalidate(doc *etree.Document, config *Config, logger io.Writer) error {
-	errors := make(chan error, 1)
-	pr, pw := io.Pipe()
-	go func() {
-		defer pw.Close()
-		if _, err := doc.WriteTo(pw); err != nil {
-			errors <- fmt.Errorf("could not write xml, %v", err)
-		}
-		errors <- nil
-	}()
+// invalidate executes the invalidation request against the configured backend
+func invalidate(config *Config, logger *events.Logger) error {
+	start := time.Now()
+	evt := events.Event{Timestamp: start, Action: events.ActionInvalidate, Key: config.Distribution.Id}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://cloudfront.amazonaws.com/2016-11-25/distribution/%s/invalidation", config.Distribution.Id), pr)
+	p, err := newProvider(config)
 	if err != nil {
-		return fmt.Errorf("could not invalidate paths, %v", err)
+		evt.Error = err.Error()
+		evt.DurationMS = time.Since(start).Milliseconds()
+		logger.Emit(evt)
+		return err
 	}
-	awsauth.Sign(req, awsauth.Credentials{
-		AccessKeyID:     config.Distribution.Accesskey,
-		SecretAccessKey: config.Distribution.Key,
+
+	err = retry.Do(retryConfig(config), func() error {
+		return p.Invalidate(config.Distribution.Id, config.Invalidation)
 	})
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	_, err = io.Copy(logger, resp.Body)
+	evt.DurationMS = time.Since(start).Milliseconds()
 	if err != nil {
-		return fmt.Errorf("could not read response from aws, %v", err)
-	}
-	if err := <-errors; err != nil {
-		return err
+		evt.Error = err.Error()
+		var statusErr *provider.StatusError
+		if stderrors.As(err, &statusErr) {
+			evt.Status = statusErr.Status
+		}
+		logger.Emit(evt)
+		return fmt.Errorf("could not invalidate paths, %v", err)
 	}
+	logger.Emit(evt)
 	return nil
 }
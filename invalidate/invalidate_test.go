@@ -0,0 +1,55 @@
+package invalidate
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/zupzup/static-aws-deploy/events"
+	"github.com/zupzup/static-aws-deploy/internal/s3test"
+)
+
+func testConfig(srv *s3test.Server) *Config {
+	config := &Config{Invalidation: []string{"/index.html", "/style.css"}}
+	config.Distribution.Id = "test-distribution"
+	config.Backend.CDNEndpoint = srv.URL()
+	config.Retry.MaxAttempts = 3
+	config.Retry.InitialDelay = time.Millisecond
+	config.Retry.MaxDelay = 5 * time.Millisecond
+	return config
+}
+
+func TestInvalidate(t *testing.T) {
+	srv := s3test.New()
+	defer srv.Close()
+
+	config := testConfig(srv)
+	logger := events.New("text", ioutil.Discard)
+
+	if err := Do(config, false, logger); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if len(srv.Invalidations) != 1 {
+		t.Fatalf("expected 1 invalidation request, got %d", len(srv.Invalidations))
+	}
+	got := srv.Invalidations[0]
+	if got.Distribution != config.Distribution.Id {
+		t.Errorf("expected distribution %q, got %q", config.Distribution.Id, got.Distribution)
+	}
+	if len(got.Paths) != len(config.Invalidation) {
+		t.Errorf("expected %d invalidated paths, got %d", len(config.Invalidation), len(got.Paths))
+	}
+}
+
+func TestInvalidateRetriesTransientFailures(t *testing.T) {
+	srv := s3test.New()
+	defer srv.Close()
+
+	config := testConfig(srv)
+	logger := events.New("text", ioutil.Discard)
+
+	srv.FailNext(2, 503)
+	if err := Do(config, false, logger); err != nil {
+		t.Fatalf("Do should have recovered after 2 injected failures, got: %v", err)
+	}
+}
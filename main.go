@@ -3,10 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/zupzup/static-aws-deploy/events"
 	"github.com/zupzup/static-aws-deploy/invalidate"
 	"github.com/zupzup/static-aws-deploy/upload"
 	yaml "gopkg.in/yaml.v2"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -25,6 +25,9 @@ var (
 	configFile string
 	dryRun     bool
 	silent     bool
+	delta      bool
+	logFormat  string
+	logFile    string
 )
 
 func init() {
@@ -34,6 +37,9 @@ func init() {
 	flag.BoolVar(&dryRun, "dr", false, "run the script without actually uploading or invalidating anything (shorthand)")
 	flag.BoolVar(&silent, "silent", false, "omit all log output")
 	flag.BoolVar(&silent, "s", false, "omit all log output (shorthand)")
+	flag.BoolVar(&delta, "delta", false, "only upload files that changed since the last deploy")
+	flag.StringVar(&logFormat, "log-format", "text", "log output format: text or json")
+	flag.StringVar(&logFile, "log-file", "", "path to write logs to (defaults to stdout)")
 }
 
 func main() {
@@ -42,15 +48,18 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	var logger io.Writer = os.Stdout
-	if silent {
-		logger = ioutil.Discard
+
+	logger, closeLogger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
 	}
-	files, err := upload.ParseFiles(&config.S3)
+	defer closeLogger()
+
+	files, err := upload.ParseFiles(&config.S3, delta, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := upload.Do(&config.S3, files, dryRun, logger); err != nil {
+	if err := upload.Do(&config.S3, files, dryRun, delta, logger); err != nil {
 		log.Fatal(err)
 	}
 	if err := invalidate.Do(&config.Cloudfront, dryRun, logger); err != nil {
@@ -58,6 +67,23 @@ func main() {
 	}
 }
 
+// newLogger builds the events.Logger to use for this run based on the
+// --silent, --log-format and --log-file flags, along with a func to close
+// the underlying log file, if one was opened
+func newLogger() (*events.Logger, func(), error) {
+	if silent {
+		return events.New(logFormat, ioutil.Discard), func() {}, nil
+	}
+	if logFile == "" {
+		return events.New(logFormat, os.Stdout), func() {}, nil
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("could not open log file: %s, %v", logFile, err)
+	}
+	return events.New(logFormat, f), func() { f.Close() }, nil
+}
+
 // readConfig reads the config from a given path and parses it
 func readConfig(path string) (*Config, error) {
 	data, err := ioutil.ReadFile(path)
@@ -71,18 +97,52 @@ func readConfig(path string) (*Config, error) {
 	if config.S3.Parallel <= 0 {
 		config.S3.Parallel = 1
 	}
-	if config.Auth.Accesskey == "" {
-		config.Auth.Accesskey = os.Getenv("AWS_ACCESS_KEY_ID")
+	if config.S3.Backend.Provider == "gcs" && config.S3.Backend.CredentialsFile == "" {
+		config.S3.Backend.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 	}
-	if config.Auth.Key == "" {
-		config.Auth.Key = os.Getenv("AWS_SECRET_ACCESS_KEY")
-	}
-	if config.Auth.Key == "" || config.Auth.Accesskey == "" {
-		return nil, fmt.Errorf("no aws credentials found")
+	if err := resolveCredentials(&config.Auth, config.S3.Backend.Provider); err != nil {
+		return nil, err
 	}
 	config.S3.Bucket.Accesskey = config.Auth.Accesskey
 	config.S3.Bucket.Key = config.Auth.Key
+	if config.S3.Backend.Provider != "" && config.Cloudfront.Backend.Provider == "" {
+		config.Cloudfront.Backend = config.S3.Backend
+	}
 	config.Cloudfront.Distribution.Accesskey = config.Auth.Accesskey
 	config.Cloudfront.Distribution.Key = config.Auth.Key
 	return &config, nil
 }
+
+// resolveCredentials fills in auth.Accesskey/Key from the environment
+// variables appropriate for the selected backend provider, if not already
+// set in the config file
+func resolveCredentials(auth *struct {
+	Accesskey string
+	Key       string
+}, provider string) error {
+	switch provider {
+	case "gcs":
+		// GCS authenticates via a service-account credentials file (see
+		// Backend.CredentialsFile / GOOGLE_APPLICATION_CREDENTIALS), not an
+		// access key pair
+		return nil
+	case "aliyun":
+		if auth.Accesskey == "" {
+			auth.Accesskey = os.Getenv("OSS_ACCESS_KEY_ID")
+		}
+		if auth.Key == "" {
+			auth.Key = os.Getenv("OSS_ACCESS_KEY_SECRET")
+		}
+	default:
+		if auth.Accesskey == "" {
+			auth.Accesskey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if auth.Key == "" {
+			auth.Key = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+	}
+	if auth.Key == "" || auth.Accesskey == "" {
+		return fmt.Errorf("no credentials found for provider %q", provider)
+	}
+	return nil
+}
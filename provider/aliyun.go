@@ -0,0 +1,225 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AliyunOSSProvider talks to Aliyun Object Storage Service and refreshes the
+// companion Aliyun CDN, using OSS's own HMAC-SHA1 request signing rather than
+// AWS SigV4
+type AliyunOSSProvider struct {
+	Endpoint    string
+	CDNEndpoint string
+	Accesskey   string
+	Key         string
+}
+
+func (p *AliyunOSSProvider) url(bucket, key string) string {
+	endpoint := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(p.Endpoint, "https://"), "http://"), "/")
+	if key == "" {
+		return fmt.Sprintf("https://%s.%s/", bucket, endpoint)
+	}
+	return fmt.Sprintf("https://%s.%s/%s", bucket, endpoint, key)
+}
+
+// sign implements OSS's "Canonicalized Resource" HMAC-SHA1 signing scheme:
+// Authorization: OSS AccessKeyId:base64(hmac-sha1(VERB\n...\nCanonicalizedResource))
+func (p *AliyunOSSProvider) sign(req *http.Request, bucket, key string) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", date)
+
+	resource := fmt.Sprintf("/%s/%s", bucket, key)
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		date,
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha1.New, []byte(p.Key))
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("OSS %s:%s", p.Accesskey, signature))
+}
+
+// List fetches all objects from the bucket and returns their keys and ETags
+func (p *AliyunOSSProvider) List(bucket string) (Delta, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", p.url(bucket, ""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bucket for delta upload, %v", err)
+	}
+	p.sign(req, bucket, "")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute request to oss, %v", err)
+	}
+	defer resp.Body.Close()
+	return parseListBucketResult(resp, "oss", false)
+}
+
+// Put uploads an object to OSS. Multipart uploads aren't implemented for OSS
+// yet, only single-shot PUTs.
+func (p *AliyunOSSProvider) Put(bucket, key string, body io.Reader, size int64, headers Header) (string, error) {
+	fileContents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("could not read body for key: %s, %v", key, err)
+	}
+	client := &http.Client{}
+	req, err := http.NewRequest("PUT", p.url(bucket, key), bytes.NewBuffer(fileContents))
+	if err != nil {
+		return "", fmt.Errorf("could not upload key to bucket: %s, %v", bucket, err)
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	p.sign(req, bucket, key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to oss, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", newStatusError(resp, fmt.Errorf("could not upload key: %s, oss returned status %d", key, resp.StatusCode))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+}
+
+// Delete removes an object from the bucket
+func (p *AliyunOSSProvider) Delete(bucket, key string) error {
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", p.url(bucket, key), nil)
+	if err != nil {
+		return fmt.Errorf("could not delete key: %s, %v", key, err)
+	}
+	p.sign(req, bucket, key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to oss, %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// rpcNonce generates the random SignatureNonce the Alibaba Cloud RPC API
+// signing spec requires to prevent replay of a signed request
+func rpcNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// percentEncode applies the RFC 3986 percent-encoding Alibaba Cloud's RPC
+// signing spec requires: url.QueryEscape's encoding, except that space
+// becomes %20 (not +), "*" is always %2A and "~" is always left literal
+func percentEncode(s string) string {
+	encoded := url.QueryEscape(s)
+	encoded = strings.ReplaceAll(encoded, "+", "%20")
+	encoded = strings.ReplaceAll(encoded, "*", "%2A")
+	encoded = strings.ReplaceAll(encoded, "%7E", "~")
+	return encoded
+}
+
+// signRPC signs params per Alibaba Cloud's RPC API "Signature Version 1.0"
+// scheme (HMAC-SHA1 over a canonicalized, percent-encoded query string),
+// used by the CDN OpenAPI. This is unrelated to OSS's bucket-resource HMAC
+// scheme implemented by sign, which only applies to OSS bucket/object calls
+func (p *AliyunOSSProvider) signRPC(method string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%s", percentEncode(k), percentEncode(params[k]))
+	}
+	canonicalized := strings.Join(pairs, "&")
+
+	stringToSign := strings.Join([]string{
+		method,
+		percentEncode("/"),
+		percentEncode(canonicalized),
+	}, "&")
+
+	mac := hmac.New(sha1.New, []byte(p.Key+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Invalidate refreshes paths on the Aliyun CDN domain fronting the bucket.
+// The CDN OpenAPI is a separate RPC-style API from OSS, signed with its own
+// query-parameter scheme (see signRPC) rather than OSS's bucket signing
+func (p *AliyunOSSProvider) Invalidate(distribution string, paths []string) error {
+	if p.CDNEndpoint == "" {
+		return fmt.Errorf("no CDNEndpoint configured for the aliyun provider")
+	}
+	domain := distribution
+	if domain == "" {
+		domain = p.CDNEndpoint
+	}
+	urls := make([]string, len(paths))
+	for i, path := range paths {
+		urls[i] = fmt.Sprintf("https://%s%s", domain, path)
+	}
+
+	nonce, err := rpcNonce()
+	if err != nil {
+		return fmt.Errorf("could not generate signature nonce, %v", err)
+	}
+
+	params := map[string]string{
+		"Action":           "RefreshObjectCaches",
+		"ObjectPath":       strings.Join(urls, "\n"),
+		"ObjectType":       "File",
+		"Format":           "JSON",
+		"Version":          "2018-05-10",
+		"AccessKeyId":      p.Accesskey,
+		"SignatureMethod":  "HMAC-SHA1",
+		"Timestamp":        time.Now().UTC().Format(time.RFC3339),
+		"SignatureVersion": "1.0",
+		"SignatureNonce":   nonce,
+	}
+	params["Signature"] = p.signRPC("POST", params)
+
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", "https://cdn.aliyuncs.com/", strings.NewReader(values.Encode()))
+	if err != nil {
+		return fmt.Errorf("could not invalidate paths, %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to aliyun cdn, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newStatusError(resp, fmt.Errorf("could not invalidate paths, aliyun cdn returned status %d", resp.StatusCode))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
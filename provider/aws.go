@@ -0,0 +1,411 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/beevik/etree"
+	awsauth "github.com/smartystreets/go-aws-auth"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPartSize is used for multipart uploads if PartSize is unset
+const defaultPartSize = 5 * 1024 * 1024
+
+// defaultS3Endpoint and defaultCloudfrontEndpoint are used when Endpoint /
+// CDNEndpoint are unset
+const (
+	defaultS3Endpoint         = "https://s3.amazonaws.com"
+	defaultCloudfrontEndpoint = "https://cloudfront.amazonaws.com"
+)
+
+// AWSProvider talks to AWS S3 and CloudFront, the original (and still
+// default) backend of static-aws-deploy
+type AWSProvider struct {
+	Accesskey string
+	Key       string
+
+	// MultipartThreshold is the size in bytes above which Put switches to
+	// the multipart upload API. 0 disables multipart uploads.
+	MultipartThreshold int64
+	// PartSize is the size in bytes of each part for multipart uploads,
+	// defaulting to defaultPartSize when unset.
+	PartSize int64
+	// Parallel is the number of parts of a multipart upload to upload
+	// concurrently, defaulting to 1 (sequential) when unset.
+	Parallel int
+
+	// Endpoint overrides the S3 endpoint, defaulting to defaultS3Endpoint.
+	// Only meant for pointing at a local test server in tests.
+	Endpoint string
+	// CDNEndpoint overrides the CloudFront endpoint, defaulting to
+	// defaultCloudfrontEndpoint. Only meant for pointing at a local test
+	// server in tests.
+	CDNEndpoint string
+
+	// pool bounds how many multipart part uploads run concurrently. SetPool
+	// shares upload.Do's own per-deploy pool here so part uploads and
+	// whole-file uploads draw from the same Parallel-sized budget instead
+	// of each multipart upload spinning up its own, independent pool (which
+	// would let concurrent large files multiply concurrency to Parallel²).
+	// If SetPool is never called, a local pool sized Parallel is created on
+	// first use.
+	pool     chan struct{}
+	poolOnce sync.Once
+}
+
+// SetPool shares pool as the semaphore this provider's multipart part
+// uploads acquire, see the pool field doc above
+func (p *AWSProvider) SetPool(pool chan struct{}) {
+	p.pool = pool
+}
+
+// partPool returns the semaphore part uploads should acquire around each
+// part's HTTP request
+func (p *AWSProvider) partPool() chan struct{} {
+	p.poolOnce.Do(func() {
+		if p.pool == nil {
+			size := p.Parallel
+			if size <= 0 {
+				size = 1
+			}
+			p.pool = make(chan struct{}, size)
+		}
+	})
+	return p.pool
+}
+
+func (p *AWSProvider) creds() awsauth.Credentials {
+	return awsauth.Credentials{AccessKeyID: p.Accesskey, SecretAccessKey: p.Key}
+}
+
+func (p *AWSProvider) s3Endpoint() string {
+	if p.Endpoint != "" {
+		return p.Endpoint
+	}
+	return defaultS3Endpoint
+}
+
+func (p *AWSProvider) cloudfrontEndpoint() string {
+	if p.CDNEndpoint != "" {
+		return p.CDNEndpoint
+	}
+	return defaultCloudfrontEndpoint
+}
+
+// List fetches all objects from the bucket and returns their keys and ETags
+func (p *AWSProvider) List(bucket string) (Delta, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/?list-type=2", p.s3Endpoint(), bucket), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bucket for delta upload, %v", err)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	return parseListBucketResult(resp, "aws", true)
+}
+
+// Put uploads an object to S3, switching to the multipart upload API for
+// objects above MultipartThreshold
+func (p *AWSProvider) Put(bucket, key string, body io.Reader, size int64, headers Header) (string, error) {
+	if p.MultipartThreshold > 0 && size > p.MultipartThreshold {
+		return p.putMultipart(bucket, key, body, headers)
+	}
+
+	fileContents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("could not read body for key: %s, %v", key, err)
+	}
+	client := &http.Client{}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s/%s", p.s3Endpoint(), bucket, key), bytes.NewBuffer(fileContents))
+	if err != nil {
+		return "", fmt.Errorf("could not upload key to bucket: %s, %v", bucket, err)
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", newStatusError(resp, fmt.Errorf("could not upload key: %s, aws returned status %d", key, resp.StatusCode))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+}
+
+// Delete removes an object from the bucket
+func (p *AWSProvider) Delete(bucket, key string) error {
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s/%s", p.s3Endpoint(), bucket, key), nil)
+	if err != nil {
+		return fmt.Errorf("could not delete key: %s, %v", key, err)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Invalidate sends an invalidation request to the CloudFront distribution
+func (p *AWSProvider) Invalidate(distribution string, paths []string) error {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	invalidationBatch := doc.CreateElement("InvalidationBatch")
+	callerReference := invalidationBatch.CreateElement("CallerReference")
+	callerReference.SetText(fmt.Sprintf("%s - %s", distribution, time.Now()))
+	pathsEl := invalidationBatch.CreateElement("Paths")
+	items := pathsEl.CreateElement("Items")
+	for _, path := range paths {
+		item := items.CreateElement("Path")
+		item.SetText(path)
+	}
+	quantity := pathsEl.CreateElement("Quantity")
+	quantity.SetText(fmt.Sprintf("%d", len(paths)))
+
+	body, err := doc.WriteToBytes()
+	if err != nil {
+		return fmt.Errorf("could not write xml, %v", err)
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/2016-11-25/distribution/%s/invalidation", p.cloudfrontEndpoint(), distribution), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not invalidate paths, %v", err)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newStatusError(resp, fmt.Errorf("could not invalidate paths, cloudfront returned status %d", resp.StatusCode))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// partUpload is the outcome of uploading a single part of a multipart upload
+type partUpload struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads body using the S3 multipart upload API, streaming it
+// part by part instead of buffering the whole file: each part is read,
+// handed off to an uploading goroutine gated by partPool (at most Parallel
+// parts in flight at once, shared with whole-file uploads via SetPool so
+// concurrency stays bounded to Parallel instead of Parallel² across several
+// concurrently-uploading large files), and released once its own upload
+// completes, so peak memory is O(Parallel*PartSize) rather than the whole
+// file. On any part error the multipart upload is aborted.
+func (p *AWSProvider) putMultipart(bucket, key string, body io.Reader, headers Header) (string, error) {
+	uploadID, err := p.initiateMultipartUpload(bucket, key, headers)
+	if err != nil {
+		return "", fmt.Errorf("could not initiate multipart upload for %s, %v", key, err)
+	}
+
+	partSize := p.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+
+	pool := p.partPool()
+	wg := sync.WaitGroup{}
+	partsMu := sync.Mutex{}
+	var parts []partUpload
+	failed := make(chan struct{})
+	errs := make(chan error, 1)
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			errs <- err
+			close(failed)
+		})
+	}
+
+	buf := make([]byte, partSize)
+	partNumber := 1
+readLoop:
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			part := make([]byte, n)
+			copy(part, buf[:n])
+			select {
+			case <-failed:
+				break readLoop
+			case pool <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(num int, part []byte) {
+				defer wg.Done()
+				defer func() { <-pool }()
+				etag, err := p.uploadPart(bucket, key, uploadID, num, part)
+				if err != nil {
+					fail(fmt.Errorf("could not upload part %d of %s, %v", num, key, err))
+					return
+				}
+				partsMu.Lock()
+				parts = append(parts, partUpload{PartNumber: num, ETag: etag})
+				partsMu.Unlock()
+			}(partNumber, part)
+			partNumber++
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			fail(fmt.Errorf("could not read body for %s, %v", key, readErr))
+			break
+		}
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		p.abortMultipartUpload(bucket, key, uploadID)
+		return "", err
+	default:
+	}
+
+	etag, err := p.completeMultipartUpload(bucket, key, uploadID, parts)
+	if err != nil {
+		p.abortMultipartUpload(bucket, key, uploadID)
+		return "", fmt.Errorf("could not complete multipart upload for %s, %v", key, err)
+	}
+	return etag, nil
+}
+
+// initiateMultipartUpload starts a multipart upload and returns the UploadId
+// assigned by S3
+func (p *AWSProvider) initiateMultipartUpload(bucket, key string, headers Header) (string, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/%s?uploads", p.s3Endpoint(), bucket, key), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create multipart upload request, %v", err)
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(resp.Body); err != nil {
+		return "", fmt.Errorf("could not parse response from aws, %v", err)
+	}
+	root := doc.SelectElement("InitiateMultipartUploadResult")
+	if root == nil {
+		return "", fmt.Errorf("could not parse response from aws, xml is malformed: missing InitiateMultipartUploadResult")
+	}
+	uploadID := root.SelectElement("UploadId")
+	if uploadID == nil {
+		return "", fmt.Errorf("could not parse response from aws, xml is malformed: missing UploadId")
+	}
+	return uploadID.Text(), nil
+}
+
+// uploadPart uploads a single part of a multipart upload and returns the
+// ETag S3 assigned to it
+func (p *AWSProvider) uploadPart(bucket, key, uploadID string, partNumber int, data []byte) (string, error) {
+	client := &http.Client{}
+	url := fmt.Sprintf("%s/%s/%s?partNumber=%d&uploadId=%s", p.s3Endpoint(), bucket, key, partNumber, uploadID)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("could not create part upload request, %v", err)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+	if etag == "" {
+		return "", fmt.Errorf("no ETag returned for part %d", partNumber)
+	}
+	return etag, nil
+}
+
+// completeMultipartUpload finalizes a multipart upload and returns the
+// composite ETag S3 assigns to the finished object
+func (p *AWSProvider) completeMultipartUpload(bucket, key, uploadID string, parts []partUpload) (string, error) {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement("CompleteMultipartUpload")
+	for _, part := range parts {
+		el := root.CreateElement("Part")
+		el.CreateElement("PartNumber").SetText(fmt.Sprintf("%d", part.PartNumber))
+		el.CreateElement("ETag").SetText(part.ETag)
+	}
+	body, err := doc.WriteToBytes()
+	if err != nil {
+		return "", fmt.Errorf("could not write xml, %v", err)
+	}
+	client := &http.Client{}
+	url := fmt.Sprintf("%s/%s/%s?uploadId=%s", p.s3Endpoint(), bucket, key, uploadID)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("could not create complete multipart upload request, %v", err)
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to aws, %v", err)
+	}
+	defer resp.Body.Close()
+	etree2 := etree.NewDocument()
+	if _, err := etree2.ReadFrom(resp.Body); err != nil {
+		return "", fmt.Errorf("could not parse response from aws, %v", err)
+	}
+	result := etree2.SelectElement("CompleteMultipartUploadResult")
+	if result == nil {
+		return "", fmt.Errorf("could not parse response from aws, xml is malformed: missing CompleteMultipartUploadResult")
+	}
+	etag := result.SelectElement("ETag")
+	if etag == nil {
+		return "", fmt.Errorf("could not parse response from aws, xml is malformed: missing ETag")
+	}
+	return strings.Trim(etag.Text(), "\""), nil
+}
+
+// abortMultipartUpload cancels an in-progress multipart upload so S3 doesn't
+// keep billing for the uploaded parts
+func (p *AWSProvider) abortMultipartUpload(bucket, key, uploadID string) {
+	client := &http.Client{}
+	url := fmt.Sprintf("%s/%s/%s?uploadId=%s", p.s3Endpoint(), bucket, key, uploadID)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return
+	}
+	awsauth.Sign(req, p.creds())
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+}
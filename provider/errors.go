@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"fmt"
+	"github.com/beevik/etree"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRetryAfter parses a Retry-After header (RFC 7231, seconds form) off a
+// throttled response, returning 0 if the header is absent or not in the
+// numeric-seconds form CloudFront and S3 use
+func parseRetryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// parseErrorCode extracts the <Code> element from an S3/OSS-style
+// <Error>...</Error> XML error body, returning "" if body isn't one
+func parseErrorCode(body []byte) string {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(body); err != nil {
+		return ""
+	}
+	root := doc.SelectElement("Error")
+	if root == nil {
+		return ""
+	}
+	code := root.SelectElement("Code")
+	if code == nil {
+		return ""
+	}
+	return code.Text()
+}
+
+// newStatusError reads resp's body to recover the backend's error code (if
+// any), then builds a StatusError describing the failed request
+func newStatusError(resp *http.Response, err error) *StatusError {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return &StatusError{
+		Status:     resp.StatusCode,
+		Code:       parseErrorCode(body),
+		RetryAfter: parseRetryAfter(resp),
+		Err:        err,
+	}
+}
+
+// parseListBucketResult parses an S3-style ListBucketResult XML bucket
+// listing into a Delta, the shape the aws, s3compatible and aliyun (oss)
+// backends all return for List, so they share this logic instead of each
+// repeating it. backend names the calling backend for error messages (e.g.
+// "aws", "oss", "provider"). requireContents preserves the aws backend's
+// existing, stricter behavior of erroring out on an entirely absent
+// <Contents> list rather than treating it as an empty bucket.
+func parseListBucketResult(resp *http.Response, backend string, requireContents bool) (Delta, error) {
+	if resp.StatusCode >= 300 {
+		return nil, newStatusError(resp, fmt.Errorf("could not list bucket for delta upload, %s returned status %d", backend, resp.StatusCode))
+	}
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("could not parse response from %s, %v", backend, err)
+	}
+	root := doc.SelectElement("ListBucketResult")
+	if root == nil {
+		return nil, fmt.Errorf("could not parse response from %s, xml is malformed: missing ListBucketResult", backend)
+	}
+	contents := root.SelectElements("Contents")
+	if requireContents && contents == nil {
+		return nil, fmt.Errorf("could not parse response from %s, xml is malformed: missing Contents", backend)
+	}
+	delta := make(Delta)
+	for _, file := range contents {
+		lastModified := file.SelectElement("LastModified")
+		etag := file.SelectElement("ETag")
+		key := file.SelectElement("Key")
+		if lastModified == nil || etag == nil || key == nil {
+			return nil, fmt.Errorf("could not parse response from %s, xml is malformed: Contents is missing ETag, Key or LastModified", backend)
+		}
+		parsedLastModified, err := time.Parse(time.RFC3339Nano, lastModified.Text())
+		if err != nil {
+			return nil, fmt.Errorf("could not parse date in response from %s: %s, %v", backend, lastModified.Text(), err)
+		}
+		delta[key.Text()] = &DeltaProperties{
+			ETag:         strings.Trim(etag.Text(), "\""),
+			LastModified: parsedLastModified,
+		}
+	}
+	return delta, nil
+}
@@ -0,0 +1,135 @@
+// Package provider abstracts the object storage + CDN backend
+// static-aws-deploy deploys to, so the upload and invalidate packages don't
+// have to hard-code s3.amazonaws.com and cloudfront.amazonaws.com.
+package provider
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Header is a simple HTTP header representation
+type Header map[string]string
+
+// DeltaProperties are the properties of a remote object used to determine
+// whether a local file has changed since it was last uploaded
+type DeltaProperties struct {
+	LastModified time.Time
+	ETag         string
+}
+
+// Delta is a mapping of remote object keys to their DeltaProperties
+type Delta map[string]*DeltaProperties
+
+// DefaultPartSize is used for multipart uploads when Config.PartSize is unset
+const DefaultPartSize = defaultPartSize
+
+// Provider is implemented by every storage backend static-aws-deploy can
+// deploy to
+type Provider interface {
+	// List returns the current state of every object in bucket, used to
+	// compute the delta against the local source tree
+	List(bucket string) (Delta, error)
+	// Put uploads size bytes read from body to bucket under key, setting
+	// headers on the request, and returns the ETag assigned to the object
+	Put(bucket, key string, body io.Reader, size int64, headers Header) (string, error)
+	// Delete removes an object from the bucket
+	Delete(bucket, key string) error
+	// Invalidate purges paths from whatever CDN sits in front of the bucket,
+	// identified by distribution (a CloudFront distribution id, an Aliyun
+	// CDN domain, ...)
+	Invalidate(distribution string, paths []string) error
+}
+
+// StatusError wraps a non-2xx HTTP response from a backend so callers can
+// recover the status code for structured logging (see the events package)
+// and decide whether the failure is worth retrying (see internal/retry)
+type StatusError struct {
+	Status int
+	// Code is the backend-specific error code, e.g. S3's "SlowDown" or
+	// "RequestLimitExceeded", parsed from the response body when present
+	Code string
+	// RetryAfter is the delay the backend asked for via a Retry-After
+	// header (CloudFront throttles invalidations this way), or 0 if absent
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *StatusError) Error() string { return e.Err.Error() }
+func (e *StatusError) Unwrap() error { return e.Err }
+
+// Config carries the settings needed to construct a Provider for whichever
+// backend is selected via the provider: key in the YAML configuration
+type Config struct {
+	// Name selects the backend: "aws" (default), "s3compatible", "aliyun" or "gcs"
+	Name string
+
+	Accesskey string
+	Key       string
+
+	// Endpoint, Region and PathStyle configure the s3compatible backend
+	// (MinIO, Aliyun OSS via its S3-compatible endpoint, SeaweedFS, ...).
+	// Endpoint also overrides the aws backend's S3 endpoint, which is only
+	// useful for pointing it at a local test server in tests.
+	Endpoint  string
+	Region    string
+	PathStyle bool
+
+	// CDNEndpoint must be set for the aliyun backend's Invalidate, which
+	// refreshes paths on the distribution domain it is passed, or on
+	// CDNEndpoint when that is empty. It also overrides the aws backend's
+	// CloudFront endpoint (same test-only use).
+	CDNEndpoint string
+
+	// CredentialsFile is the path to a GCS service-account JSON key
+	CredentialsFile string
+
+	// MultipartThreshold and PartSize configure multipart uploads on
+	// providers that support the S3 multipart API. Parallel caps how many
+	// parts of a multipart upload are uploaded concurrently.
+	MultipartThreshold int64
+	PartSize           int64
+	Parallel           int
+}
+
+// New constructs the Provider selected by config.Name
+func New(config Config) (Provider, error) {
+	switch config.Name {
+	case "", "aws", "s3":
+		return &AWSProvider{
+			Accesskey:          config.Accesskey,
+			Key:                config.Key,
+			MultipartThreshold: config.MultipartThreshold,
+			PartSize:           config.PartSize,
+			Parallel:           config.Parallel,
+			Endpoint:           config.Endpoint,
+			CDNEndpoint:        config.CDNEndpoint,
+		}, nil
+	case "s3compatible":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("s3compatible provider requires an endpoint")
+		}
+		return &S3CompatibleProvider{
+			Endpoint:  config.Endpoint,
+			Region:    config.Region,
+			PathStyle: config.PathStyle,
+			Accesskey: config.Accesskey,
+			Key:       config.Key,
+		}, nil
+	case "aliyun":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("aliyun provider requires an endpoint")
+		}
+		return &AliyunOSSProvider{
+			Endpoint:    config.Endpoint,
+			CDNEndpoint: config.CDNEndpoint,
+			Accesskey:   config.Accesskey,
+			Key:         config.Key,
+		}, nil
+	case "gcs":
+		return NewGCSProvider(config.CredentialsFile)
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", config.Name)
+	}
+}
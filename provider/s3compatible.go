@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	awsauth "github.com/smartystreets/go-aws-auth"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// S3CompatibleProvider talks to any object store that implements the S3 API
+// (MinIO, Aliyun OSS via its S3-compatible endpoint, SeaweedFS, ...) against
+// a custom Endpoint/Region instead of s3.amazonaws.com
+type S3CompatibleProvider struct {
+	Endpoint  string
+	Region    string
+	PathStyle bool
+	Accesskey string
+	Key       string
+}
+
+func (p *S3CompatibleProvider) creds() awsauth.Credentials {
+	return awsauth.Credentials{AccessKeyID: p.Accesskey, SecretAccessKey: p.Key}
+}
+
+// url builds the request URL for a bucket/key pair, honoring PathStyle for
+// stores that don't support virtual-hosted buckets
+func (p *S3CompatibleProvider) url(bucket, key string) string {
+	endpoint := strings.TrimSuffix(p.Endpoint, "/")
+	if p.PathStyle {
+		if key == "" {
+			return fmt.Sprintf("%s/%s", endpoint, bucket)
+		}
+		return fmt.Sprintf("%s/%s/%s", endpoint, bucket, key)
+	}
+	scheme, host := splitScheme(endpoint)
+	if key == "" {
+		return fmt.Sprintf("%s%s.%s", scheme, bucket, host)
+	}
+	return fmt.Sprintf("%s%s.%s/%s", scheme, bucket, host, key)
+}
+
+func splitScheme(endpoint string) (scheme, host string) {
+	if strings.HasPrefix(endpoint, "https://") {
+		return "https://", strings.TrimPrefix(endpoint, "https://")
+	}
+	if strings.HasPrefix(endpoint, "http://") {
+		return "http://", strings.TrimPrefix(endpoint, "http://")
+	}
+	return "https://", endpoint
+}
+
+func (p *S3CompatibleProvider) sign(req *http.Request) {
+	if p.Region != "" {
+		awsauth.Sign4(req, p.creds())
+		return
+	}
+	awsauth.Sign(req, p.creds())
+}
+
+// List fetches all objects from the bucket and returns their keys and ETags
+func (p *S3CompatibleProvider) List(bucket string) (Delta, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?list-type=2", p.url(bucket, "")), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get bucket for delta upload, %v", err)
+	}
+	p.sign(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute request to provider, %v", err)
+	}
+	defer resp.Body.Close()
+	return parseListBucketResult(resp, "provider", false)
+}
+
+// Put uploads an object. Multipart uploads aren't implemented for generic
+// S3-compatible stores yet, only single-shot PUTs.
+func (p *S3CompatibleProvider) Put(bucket, key string, body io.Reader, size int64, headers Header) (string, error) {
+	fileContents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("could not read body for key: %s, %v", key, err)
+	}
+	client := &http.Client{}
+	req, err := http.NewRequest("PUT", p.url(bucket, key), bytes.NewBuffer(fileContents))
+	if err != nil {
+		return "", fmt.Errorf("could not upload key to bucket: %s, %v", bucket, err)
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	p.sign(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not execute request to provider, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", newStatusError(resp, fmt.Errorf("could not upload key: %s, provider returned status %d", key, resp.StatusCode))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+}
+
+// Delete removes an object from the bucket
+func (p *S3CompatibleProvider) Delete(bucket, key string) error {
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", p.url(bucket, key), nil)
+	if err != nil {
+		return fmt.Errorf("could not delete key: %s, %v", key, err)
+	}
+	p.sign(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to provider, %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Invalidate is not supported for generic S3-compatible stores, since they
+// aren't generally paired with a CDN this tool knows how to address; it
+// always returns an error
+func (p *S3CompatibleProvider) Invalidate(distribution string, paths []string) error {
+	return fmt.Errorf("invalidation is not supported for the s3compatible provider")
+}
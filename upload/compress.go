@@ -0,0 +1,65 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"regexp"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMatch reports whether path should be pre-compressed per
+// config.Compress, given its uncompressed size
+func compressMatch(config *Config, path string, size int64) (bool, error) {
+	if len(config.Compress.Algorithms) == 0 {
+		return false, nil
+	}
+	if config.Compress.MinSize > 0 && size < config.Compress.MinSize {
+		return false, nil
+	}
+	if config.Compress.Regex == "" {
+		return true, nil
+	}
+	re, err := regexp.Compile(config.Compress.Regex)
+	if err != nil {
+		return false, fmt.Errorf("could not parse compress regex: %s, %v", config.Compress.Regex, err)
+	}
+	return re.MatchString(path), nil
+}
+
+// hasAlgorithm reports whether name is one of config.Compress.Algorithms
+func hasAlgorithm(config *Config, name string) bool {
+	for _, algorithm := range config.Compress.Algorithms {
+		if algorithm == name {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBytes compresses data with gzip at the default compression level
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// brotliBytes compresses data with Brotli at the default quality level
+func brotliBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -3,12 +3,13 @@ package upload
 import (
 	"bytes"
 	"crypto/md5"
+	stderrors "errors"
 	"fmt"
-	"github.com/beevik/etree"
-	awsauth "github.com/smartystreets/go-aws-auth"
+	"github.com/zupzup/static-aws-deploy/events"
+	"github.com/zupzup/static-aws-deploy/internal/retry"
+	"github.com/zupzup/static-aws-deploy/provider"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -18,19 +19,16 @@ import (
 )
 
 // Header is a simple HTTP header representation
-type Header map[string]string
+type Header = provider.Header
 
 // Files is a map from filename to a HTTP header configuration
 type Files map[string][]Header
 
 // Delta is a mapping of files to their DeltaProperties
-type Delta map[string]*DeltaProperties
+type Delta = provider.Delta
 
 // DeltaProperties are the properties of a file used to determine if it has been changed
-type DeltaProperties struct {
-	LastModified time.Time
-	ETag         string
-}
+type DeltaProperties = provider.DeltaProperties
 
 // Config is the configuration object for the uploader
 type Config struct {
@@ -42,16 +40,83 @@ type Config struct {
 	Parallel int
 	Source   string
 	Ignore   string
+	// MultipartThreshold is the file size in bytes above which the aws
+	// backend's Put switches to the multipart upload API. 0 disables
+	// multipart uploads. The other backends upload every file in a single
+	// request.
+	MultipartThreshold int64 `yaml:"multipart_threshold"`
+	// PartSize is the size in bytes of each part for multipart uploads,
+	// defaulting to provider.DefaultPartSize when unset.
+	PartSize int64 `yaml:"part_size"`
+	// Backend selects and configures the storage provider to deploy to.
+	// Backend.Provider defaults to AWS S3 when empty.
+	Backend struct {
+		Provider        string
+		Endpoint        string
+		Region          string
+		PathStyle       bool   `yaml:"path_style"`
+		CDNEndpoint     string `yaml:"cdn_endpoint"`
+		CredentialsFile string `yaml:"credentials_file"`
+	}
 	Metadata []struct {
 		Regex   string
 		Headers []Header
 	}
+	// Retry configures the backoff used for transient upload/delta-listing
+	// failures. Zero values fall back to retry.DefaultConfig.
+	Retry struct {
+		MaxAttempts  int           `yaml:"max_attempts"`
+		InitialDelay time.Duration `yaml:"initial_delay"`
+		MaxDelay     time.Duration `yaml:"max_delay"`
+	}
+	// Compress pre-compresses matching files in-memory before uploading
+	// them. Empty Algorithms disables compression.
+	Compress struct {
+		// Algorithms selects which compressed variants to produce: "gzip"
+		// replaces the uploaded object in place (Content-Encoding: gzip),
+		// "br" additionally uploads a Brotli-compressed ".br" variant
+		// alongside the original so a CDN can pick either by Accept-Encoding.
+		Algorithms []string
+		// MinSize is the file size in bytes below which compression is
+		// skipped. 0 compresses every matching file.
+		MinSize int64 `yaml:"min_size"`
+		// Regex restricts compression to matching file paths. Empty matches
+		// every file.
+		Regex string
+	}
+}
+
+// retryConfig builds a retry.Config from config.Retry
+func retryConfig(config *Config) retry.Config {
+	return retry.Config{
+		MaxAttempts:  config.Retry.MaxAttempts,
+		InitialDelay: config.Retry.InitialDelay,
+		MaxDelay:     config.Retry.MaxDelay,
+	}
+}
+
+// newProvider builds the Provider selected by config.Backend.Provider
+func newProvider(config *Config) (provider.Provider, error) {
+	return provider.New(provider.Config{
+		Name:               config.Backend.Provider,
+		Accesskey:          config.Bucket.Accesskey,
+		Key:                config.Bucket.Key,
+		Endpoint:           config.Backend.Endpoint,
+		Region:             config.Backend.Region,
+		PathStyle:          config.Backend.PathStyle,
+		CDNEndpoint:        config.Backend.CDNEndpoint,
+		CredentialsFile:    config.Backend.CredentialsFile,
+		MultipartThreshold: config.MultipartThreshold,
+		PartSize:           config.PartSize,
+		Parallel:           config.Parallel,
+	})
 }
 
 // ParseFiles builds a metadata object based on the sourcefiles and
 // the provided configuration, which indicates which files will get uploaded
-// and the headers to set for those files
-func ParseFiles(config *Config, delta bool) (Files, error) {
+// and the headers to set for those files. Files a delta upload leaves
+// untouched are reported to logger as ActionSkip events.
+func ParseFiles(config *Config, delta bool, logger *events.Logger) (Files, error) {
 	source := config.Source
 	if source == "" {
 		return nil, fmt.Errorf("no source specified")
@@ -75,13 +140,15 @@ func ParseFiles(config *Config, delta bool) (Files, error) {
 		if !info.IsDir() && !re.MatchString(path) {
 			hasChanged := true
 			if delta {
-				hasChanged, err = hasFileChanged(info, deltaMap, getUploadPath(config, path), path)
+				hasChanged, err = hasFileChanged(config, info, deltaMap, getUploadPath(config, path), path)
 				if err != nil {
 					return err
 				}
 			}
 			if hasChanged {
 				result[path] = []Header{}
+			} else if logger != nil {
+				logger.Emit(events.Event{Action: events.ActionSkip, File: path, Key: getUploadPath(config, path)})
 			}
 		}
 		return nil
@@ -107,8 +174,8 @@ func ParseFiles(config *Config, delta bool) (Files, error) {
 
 // hasFileChanged checks the md5 sum against the ETag of the uploaded files as well as the
 // lastmodified date
-func hasFileChanged(info os.FileInfo, deltaMap Delta, uploadPath, filePath string) (bool, error) {
-	etag, err := calculateETag(filePath)
+func hasFileChanged(config *Config, info os.FileInfo, deltaMap Delta, uploadPath, filePath string) (bool, error) {
+	etag, err := calculateETag(config, filePath)
 	if err != nil {
 		return false, err
 	}
@@ -119,89 +186,157 @@ func hasFileChanged(info os.FileInfo, deltaMap Delta, uploadPath, filePath strin
 	return true, nil
 }
 
-// calculateETag generates the md5 sum of the given file
-func calculateETag(path string) (string, error) {
-	bytes, err := ioutil.ReadFile(path)
+// calculateETag generates the md5 sum of the given file. For files uploaded
+// via the multipart API it instead generates the composite ETag S3 assigns
+// to multipart objects, so delta comparison still works for them. For files
+// gzip-compressed on upload, the sum is taken over the compressed bytes, so
+// delta comparison still works for them too.
+func calculateETag(config *Config, path string) (string, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return "", fmt.Errorf("could not read file: %s while calculating it's ETag, %v", path, err)
+		return "", fmt.Errorf("could not stat file: %s while calculating it's ETag, %v", path, err)
 	}
-	return fmt.Sprintf("%x", md5.Sum(bytes)), nil
-}
-
-// getDeltaMap fetches all files from S3 and returns their keys and ETags
-func getDeltaMap(config *Config) (Delta, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://s3.amazonaws.com/%s/?list-type=2", config.Bucket.Name), nil)
+	if config.MultipartThreshold > 0 && info.Size() > config.MultipartThreshold {
+		return calculateMultipartETag(path, config.PartSize)
+	}
+	fileBytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not get bucket for delta upload, %v", err)
+		return "", fmt.Errorf("could not read file: %s while calculating it's ETag, %v", path, err)
 	}
-	awsauth.Sign(req, awsauth.Credentials{
-		AccessKeyID:     config.Bucket.Accesskey,
-		SecretAccessKey: config.Bucket.Key,
-	})
-	resp, err := client.Do(req)
+	compress, err := compressMatch(config, path, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("could not execute request to aws, %v", err)
+		return "", err
+	}
+	if compress && hasAlgorithm(config, "gzip") {
+		fileBytes, err = gzipBytes(fileBytes)
+		if err != nil {
+			return "", fmt.Errorf("could not gzip file: %s while calculating it's ETag, %v", path, err)
+		}
 	}
-	defer resp.Body.Close()
-	doc := etree.NewDocument()
-	if _, err := doc.ReadFrom(resp.Body); err != nil {
-		return nil, fmt.Errorf("could not parse response from aws, %v", err)
+	return fmt.Sprintf("%x", md5.Sum(fileBytes)), nil
+}
+
+// calculateMultipartETag computes md5(concat(partMD5s))-N, the same composite
+// ETag format S3 returns for objects that were uploaded via the multipart API
+func calculateMultipartETag(path string, partSize int64) (string, error) {
+	if partSize <= 0 {
+		partSize = provider.DefaultPartSize
 	}
-	root := doc.SelectElement("ListBucketResult")
-	if root == nil {
-		return nil, fmt.Errorf("could not parse response from aws, xml is malformed: missing ListBucketResult")
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open file: %s while calculating it's ETag, %v", path, err)
 	}
-	deltaMap := make(Delta)
-	contents := root.SelectElements("Contents")
-	if contents == nil {
-		return nil, fmt.Errorf("could not parse response from aws, xml is malformed: missing Contents")
-	}
-	for _, file := range contents {
-		lastModified := file.SelectElement("LastModified")
-		etag := file.SelectElement("ETag")
-		key := file.SelectElement("Key")
-		if lastModified == nil || etag == nil || key == nil {
-			return nil, fmt.Errorf("could not parse response from aws, xml is malformed: Contents is missing ETag, Key or LastModified")
+	defer f.Close()
+
+	var concatenated []byte
+	parts := 0
+	buf := make([]byte, partSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := md5.Sum(buf[:n])
+			concatenated = append(concatenated, sum[:]...)
+			parts++
 		}
-		parsedLastModified, err := time.Parse(time.RFC3339Nano, lastModified.Text())
-		if err != nil {
-			return nil, fmt.Errorf("could not parse date in response from aws: %s, %v", lastModified, err)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
 		}
-		deltaProp := DeltaProperties{
-			ETag:         strings.Trim(etag.Text(), "\""),
-			LastModified: parsedLastModified,
+		if err != nil {
+			return "", fmt.Errorf("could not read file: %s while calculating it's ETag, %v", path, err)
 		}
-		deltaMap[key.Text()] = &deltaProp
 	}
-	return deltaMap, nil
+	return fmt.Sprintf("%x-%d", md5.Sum(concatenated), parts), nil
+}
+
+// getDeltaMap fetches all files from the configured backend and returns their keys and ETags,
+// retrying transient backend failures
+func getDeltaMap(config *Config) (Delta, error) {
+	p, err := newProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	var delta Delta
+	err = retry.Do(retryConfig(config), func() error {
+		var err error
+		delta, err = p.List(config.Bucket.Name)
+		return err
+	})
+	return delta, err
+}
+
+// poolAware is implemented by providers whose Put needs extra internal
+// concurrency of its own (AWSProvider's multipart part uploads) and so
+// needs to share Do's per-deploy worker pool, keeping total concurrent
+// requests bounded by config.Parallel instead of Parallel² once several
+// large files upload at once.
+type poolAware interface {
+	SetPool(pool chan struct{})
 }
 
-// Do iterates over the files concurrently and calls
-// uploadFile for each file, printing progress indication to logger
-func Do(config *Config, files Files, dryRun, delta bool, logger io.Writer) error {
+// Do iterates over the files concurrently and calls uploadFile for each
+// file, emitting an events.Event for every upload or dry-run action (skips
+// are emitted by ParseFiles)
+func Do(config *Config, files Files, dryRun, delta bool, logger *events.Logger) error {
 	if config.Bucket.Name == "" {
 		return fmt.Errorf("no bucket specified")
 	}
+	p, err := newProvider(config)
+	if err != nil {
+		return err
+	}
 	poolSize := config.Parallel
+	if poolSize <= 0 {
+		poolSize = 1
+	}
 	wg := sync.WaitGroup{}
 	pool := make(chan struct{}, poolSize)
+	pa, partPooled := p.(poolAware)
+	if partPooled {
+		pa.SetPool(pool)
+	}
 	errors := make(chan error, 1)
 	finished := make(chan bool, 1)
 
-	fmt.Fprintf(logger, "%d Files to upload (%d concurrently)...\n", len(files), poolSize)
 	for key, value := range files {
 		wg.Add(1)
 		go func(config *Config, file string, headers []Header) {
 			defer wg.Done()
-			pool <- struct{}{}
-			defer func() { <-pool }()
-			if !dryRun {
-				if err := uploadFile(config, file, headers, logger); err != nil {
-					errors <- err
+
+			start := time.Now()
+			uploadPath := getUploadPath(config, file)
+			if dryRun {
+				logger.Emit(events.Event{Timestamp: start, Action: events.ActionDryRun, File: file, Key: uploadPath})
+				return
+			}
+
+			evt := events.Event{Timestamp: start, Action: events.ActionUpload, File: file, Key: uploadPath}
+			info, statErr := os.Stat(file)
+			if statErr == nil {
+				evt.Size = info.Size()
+			}
+			// Files going through the multipart API gate their own
+			// concurrency per-part via the same pool (see poolAware), so
+			// this orchestrating goroutine doesn't also hold a slot for the
+			// whole file's duration - doing so would starve part uploads of
+			// that slot (or deadlock outright at Parallel==1).
+			multipart := partPooled && statErr == nil && config.MultipartThreshold > 0 && info.Size() > config.MultipartThreshold
+			if !multipart {
+				pool <- struct{}{}
+				defer func() { <-pool }()
+			}
+			etag, err := uploadFile(config, p, file, headers)
+			evt.DurationMS = time.Since(start).Milliseconds()
+			if err != nil {
+				evt.Error = err.Error()
+				var statusErr *provider.StatusError
+				if stderrors.As(err, &statusErr) {
+					evt.Status = statusErr.Status
 				}
+				errors <- err
+			} else {
+				evt.ETag = etag
 			}
-			fmt.Fprintf(logger, "%s...Done.\n", file)
+			logger.Emit(evt)
 		}(config, key, value)
 	}
 
@@ -212,14 +347,6 @@ func Do(config *Config, files Files, dryRun, delta bool, logger io.Writer) error
 
 	select {
 	case <-finished:
-		finishMessage := "Upload finished."
-		if dryRun {
-			finishMessage = "Dry Run finished."
-		}
-		if delta {
-			finishMessage = fmt.Sprintf("Delta %s", finishMessage)
-		}
-		fmt.Fprintln(logger, finishMessage)
 	case err := <-errors:
 		if err != nil {
 			return err
@@ -233,42 +360,106 @@ func getUploadPath(config *Config, filePath string) string {
 	return strings.TrimPrefix(filePath, fmt.Sprintf("%s/", filepath.Clean(config.Source)))
 }
 
-// uploadFile uploads a file to AWS S3 with the given headers,
-// not chunked currently
-func uploadFile(config *Config, file string, headers []Header, logger io.Writer) error {
+// uploadFile uploads a file to the configured backend with the given
+// headers and returns the ETag the backend assigned to it, retrying
+// transient backend failures. p is shared across all files in a Do call so
+// that providers needing per-deploy setup (e.g. GCS's OAuth2 token) only
+// pay that cost once.
+func uploadFile(config *Config, p provider.Provider, file string, headers []Header) (string, error) {
 	uploadPath := getUploadPath(config, file)
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("could not stat file: %s, %v", file, err)
+	}
+
+	mergedHeaders := provider.Header{}
+	for _, header := range headers {
+		for k, v := range header {
+			mergedHeaders[k] = v
+		}
+	}
+
+	// Compression is only attempted for files small enough to be handled
+	// in-memory, i.e. ones that won't go through the multipart upload API.
+	compress, err := compressMatch(config, file, info.Size())
+	if err != nil {
+		return "", err
+	}
+	if compress && (config.MultipartThreshold <= 0 || info.Size() <= config.MultipartThreshold) {
+		return uploadCompressed(config, p, file, uploadPath, mergedHeaders)
+	}
+
 	f, err := os.Open(file)
 	if err != nil {
-		return fmt.Errorf("could not open file: %s, %v", file, err)
+		return "", fmt.Errorf("could not open file: %s, %v", file, err)
 	}
 	defer f.Close()
 
-	fileContents, err := ioutil.ReadAll(f)
+	var etag string
+	err = retry.Do(retryConfig(config), func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("could not seek file: %s, %v", file, err)
+		}
+		var putErr error
+		etag, putErr = p.Put(config.Bucket.Name, uploadPath, f, info.Size(), mergedHeaders)
+		return putErr
+	})
 	if err != nil {
-		return fmt.Errorf("could not read file: %s, %v", file, err)
+		return "", fmt.Errorf("could not upload file: %s, %w", file, err)
 	}
-	client := &http.Client{}
-	req, err := http.NewRequest("PUT", fmt.Sprintf("https://s3.amazonaws.com/%s/%s", config.Bucket.Name, uploadPath), bytes.NewBuffer(fileContents))
+	return etag, nil
+}
+
+// uploadCompressed reads file fully into memory, compresses it per
+// config.Compress.Algorithms and uploads the result under uploadPath. If
+// "br" is configured, a second, Brotli-compressed variant
+// is additionally uploaded under uploadPath + ".br", leaving the primary
+// object's encoding untouched by the Brotli pass. Returns the ETag of the
+// primary upload, the one used for delta comparison.
+func uploadCompressed(config *Config, p provider.Provider, file, uploadPath string, headers provider.Header) (string, error) {
+	raw, err := ioutil.ReadFile(file)
 	if err != nil {
-		return fmt.Errorf("could not upload file to bucket: %s, %v", config.Bucket.Name, err)
+		return "", fmt.Errorf("could not read file: %s, %v", file, err)
 	}
-	for _, header := range headers {
-		for k, v := range header {
-			req.Header.Add(k, v)
+
+	body := raw
+	if hasAlgorithm(config, "gzip") {
+		body, err = gzipBytes(raw)
+		if err != nil {
+			return "", fmt.Errorf("could not gzip file: %s, %v", file, err)
 		}
+		headers["Content-Encoding"] = "gzip"
 	}
-	awsauth.Sign(req, awsauth.Credentials{
-		AccessKeyID:     config.Bucket.Accesskey,
-		SecretAccessKey: config.Bucket.Key,
+
+	var etag string
+	err = retry.Do(retryConfig(config), func() error {
+		var putErr error
+		etag, putErr = p.Put(config.Bucket.Name, uploadPath, bytes.NewReader(body), int64(len(body)), headers)
+		return putErr
 	})
-	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("could not execute request to aws, %v", err)
+		return "", fmt.Errorf("could not upload file: %s, %w", file, err)
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(logger, resp.Body)
-	if err != nil {
-		return fmt.Errorf("could not read response from aws, %v", err)
+
+	if hasAlgorithm(config, "br") {
+		brBody, err := brotliBytes(raw)
+		if err != nil {
+			return "", fmt.Errorf("could not brotli-compress file: %s, %v", file, err)
+		}
+		brHeaders := provider.Header{}
+		for k, v := range headers {
+			brHeaders[k] = v
+		}
+		brHeaders["Content-Encoding"] = "br"
+		err = retry.Do(retryConfig(config), func() error {
+			_, putErr := p.Put(config.Bucket.Name, uploadPath+".br", bytes.NewReader(brBody), int64(len(brBody)), brHeaders)
+			return putErr
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not upload brotli variant of file: %s, %w", file, err)
+		}
 	}
-	return nil
+
+	return etag, nil
 }
@@ -0,0 +1,133 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zupzup/static-aws-deploy/events"
+	"github.com/zupzup/static-aws-deploy/internal/s3test"
+)
+
+func testConfig(t *testing.T, srv *s3test.Server, source string) *Config {
+	t.Helper()
+	config := &Config{
+		Parallel: 2,
+		Source:   source,
+		// matches nothing a test ever writes, so ParseFiles' !re.MatchString
+		// inclusion check doesn't exclude every file (the zero value, "",
+		// compiles to a regex that matches everything)
+		Ignore: `^nonexistent-ignore-pattern$`,
+	}
+	config.Bucket.Name = "test-bucket"
+	config.Backend.Endpoint = srv.URL()
+	config.Retry.MaxAttempts = 3
+	config.Retry.InitialDelay = time.Millisecond
+	config.Retry.MaxDelay = 5 * time.Millisecond
+	return config
+}
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatalf("could not write test file: %v", err)
+	}
+}
+
+func TestUploadAndDeltaSkip(t *testing.T) {
+	srv := s3test.New()
+	defer srv.Close()
+
+	source, err := ioutil.TempDir("", "upload-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(source)
+	writeFile(t, source, "index.html", "<html></html>")
+
+	config := testConfig(t, srv, source)
+	logger := events.New("text", ioutil.Discard)
+
+	files, err := ParseFiles(config, false, logger)
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file to upload, got %d", len(files))
+	}
+	if err := Do(config, files, false, false, logger); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	// a second delta run over unchanged files should upload nothing
+	files, err = ParseFiles(config, true, logger)
+	if err != nil {
+		t.Fatalf("ParseFiles (delta): %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected delta run to skip unchanged file, got %d files", len(files))
+	}
+}
+
+func TestUploadRetriesTransientFailures(t *testing.T) {
+	srv := s3test.New()
+	defer srv.Close()
+
+	source, err := ioutil.TempDir("", "upload-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(source)
+	writeFile(t, source, "style.css", "body{}")
+
+	config := testConfig(t, srv, source)
+	logger := events.New("text", ioutil.Discard)
+
+	files, err := ParseFiles(config, false, logger)
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+
+	srv.FailNext(2, 503)
+	if err := Do(config, files, false, false, logger); err != nil {
+		t.Fatalf("Do should have recovered after 2 injected failures, got: %v", err)
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	srv := s3test.New()
+	defer srv.Close()
+
+	source, err := ioutil.TempDir("", "upload-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(source)
+	writeFile(t, source, "bigfile.bin", strings.Repeat("x", 30))
+
+	config := testConfig(t, srv, source)
+	config.MultipartThreshold = 10
+	config.PartSize = 10
+	logger := events.New("text", ioutil.Discard)
+
+	files, err := ParseFiles(config, false, logger)
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+	if err := Do(config, files, false, false, logger); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	// a second delta run over the unchanged multipart-uploaded file should
+	// upload nothing, proving its composite ETag round-trips correctly
+	files, err = ParseFiles(config, true, logger)
+	if err != nil {
+		t.Fatalf("ParseFiles (delta): %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected delta run to skip unchanged multipart file, got %d files", len(files))
+	}
+}